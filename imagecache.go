@@ -0,0 +1,196 @@
+// Copyright 2014 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebiten
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// CacheStats is a snapshot of an ImageCache's usage counters.
+type CacheStats struct {
+	Hits    int
+	Misses  int
+	Entries int
+	Bytes   int64
+}
+
+type imageCacheEntry struct {
+	key   string
+	image *Image
+	bytes int64
+}
+
+// ImageCache is a fixed-capacity cache of *Image values keyed by string.
+//
+// Unlike NewImage and NewImageFromImage, whose results live until the
+// process exits (see their doc comments), an ImageCache bounds the number
+// of live images (and, optionally, the VRAM they occupy) by evicting and
+// disposing the least recently used entry once the budget is exceeded.
+//
+// ImageCache is safe for concurrent use.
+type ImageCache struct {
+	m sync.Mutex
+
+	filter     Filter
+	maxEntries int
+	maxBytes   int64
+
+	curBytes int64
+	ll       *list.List
+	items    map[string]*list.Element
+
+	hits   int
+	misses int
+}
+
+// NewImageCache creates an ImageCache that uploads its images with the
+// given filter.
+//
+// maxEntries bounds the number of cached images; 0 means no limit on the
+// entry count. maxBytes bounds the total VRAM (width * height * 4 bytes
+// per image) the cache may hold; 0 means no limit on bytes. At least one
+// of maxEntries or maxBytes should be positive, or the cache will never
+// evict anything.
+//
+// maxBytes is a soft budget: the most-recently-inserted entry is never
+// evicted, so a single image larger than maxBytes is still cached and
+// simply keeps the cache over budget rather than being disposed and
+// reloaded on every Get.
+func NewImageCache(maxEntries int, maxBytes int64, filter Filter) *ImageCache {
+	return &ImageCache{
+		filter:     filter,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+// Get returns the *Image cached under key, calling loader and uploading
+// its result if key is not already cached.
+//
+// If loader returns an error, Get returns that error and nothing is
+// cached. The returned *Image must not be disposed by the caller; the
+// cache owns its lifetime and disposes it automatically on eviction.
+//
+// This function is concurrent-safe.
+func (c *ImageCache) Get(key string, loader func() (image.Image, error)) (*Image, error) {
+	c.m.Lock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		c.hits++
+		img := e.Value.(*imageCacheEntry).image
+		c.m.Unlock()
+		return img, nil
+	}
+	c.misses++
+	c.m.Unlock()
+
+	src, err := loader()
+	if err != nil {
+		return nil, err
+	}
+	img, err := NewImageFromImage(src, c.filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// Another goroutine might have raced us and already inserted key
+	// while we were decoding and uploading. Keep its entry and dispose
+	// of the redundant upload instead of caching a duplicate.
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		img.Dispose()
+		return e.Value.(*imageCacheEntry).image, nil
+	}
+
+	w, h := img.Size()
+	entry := &imageCacheEntry{
+		key:   key,
+		image: img,
+		bytes: int64(w) * int64(h) * 4,
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	c.curBytes += entry.bytes
+	c.evict()
+	return img, nil
+}
+
+// evict removes least-recently-used entries until the cache is within
+// budget. The caller must hold c.m.
+//
+// The most-recently-inserted entry is never evicted, even if it alone
+// exceeds maxBytes: evicting it would dispose the *Image this call is
+// about to return to the caller, and the next Get of the same key would
+// reload, re-upload and re-dispose it forever. This makes maxBytes a
+// soft budget with a floor of one image's worth of bytes.
+func (c *ImageCache) evict() {
+	newest := c.ll.Front()
+	for {
+		overEntries := c.maxEntries > 0 && c.ll.Len() > c.maxEntries
+		overBytes := c.maxBytes > 0 && c.curBytes > c.maxBytes
+		if !overEntries && !overBytes {
+			return
+		}
+		back := c.ll.Back()
+		if back == nil || back == newest {
+			return
+		}
+		c.removeElement(back)
+	}
+}
+
+// removeElement disposes the image backing e and removes it from the
+// cache. Once removed here, the key is gone from c.items, so the same
+// entry can never be disposed twice even if the caller still holds a
+// reference to the returned *Image.
+func (c *ImageCache) removeElement(e *list.Element) {
+	entry := e.Value.(*imageCacheEntry)
+	c.ll.Remove(e)
+	delete(c.items, entry.key)
+	c.curBytes -= entry.bytes
+	entry.image.Dispose()
+}
+
+// Remove evicts key from the cache, disposing its image, if present.
+//
+// This function is concurrent-safe.
+func (c *ImageCache) Remove(key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+// Stats returns a snapshot of the cache's hit/miss counters and current
+// occupancy. Games can use this to tune maxEntries and maxBytes.
+//
+// This function is concurrent-safe.
+func (c *ImageCache) Stats() CacheStats {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return CacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: c.ll.Len(),
+		Bytes:   c.curBytes,
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2014 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebiten
+
+import (
+	"image"
+	"testing"
+)
+
+// withDeferredCommands makes Image-mutating calls (NewImage,
+// NewImageFromImage, Dispose, ...) enqueue their commands instead of
+// executing them against a real GL context, the same thing that happens
+// to any such call made before the first frame is flushed. This lets
+// ImageCache's bookkeeping be exercised without a GPU.
+func withDeferredCommands(t *testing.T) func() {
+	t.Helper()
+	old := imageCommandQueue
+	imageCommandQueue = append(imageCommandQueue, &fillCommand{})
+	imageCommandQueue = imageCommandQueue[1:]
+	return func() { imageCommandQueue = old }
+}
+
+func countQueuedDisposes(img *Image) int {
+	n := 0
+	for _, c := range imageCommandQueue {
+		if d, ok := c.(*disposeCommand); ok && d.image == img {
+			n++
+		}
+	}
+	return n
+}
+
+func smallImageLoader() (image.Image, error) {
+	return image.NewRGBA(image.Rect(0, 0, 4, 4)), nil
+}
+
+func TestImageCacheHitsAndMisses(t *testing.T) {
+	defer withDeferredCommands(t)()
+
+	c := NewImageCache(0, 0, FilterNearest)
+
+	if _, err := c.Get("a", smallImageLoader); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("a", smallImageLoader); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("b", smallImageLoader); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := c.Stats()
+	if stats.Misses != 2 {
+		t.Errorf("Misses = %d, want 2", stats.Misses)
+	}
+	if stats.Hits != 1 {
+		t.Errorf("Hits = %d, want 1", stats.Hits)
+	}
+	if stats.Entries != 2 {
+		t.Errorf("Entries = %d, want 2", stats.Entries)
+	}
+	if stats.Bytes != 2*4*4*4 {
+		t.Errorf("Bytes = %d, want %d", stats.Bytes, 2*4*4*4)
+	}
+}
+
+func TestImageCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	defer withDeferredCommands(t)()
+
+	c := NewImageCache(2, 0, FilterNearest)
+
+	imgA, err := c.Get("a", smallImageLoader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgB, err := c.Get("b", smallImageLoader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Touching "a" again makes "b" the least recently used entry.
+	if _, err := c.Get("a", smallImageLoader); err != nil {
+		t.Fatal(err)
+	}
+
+	// Inserting a third entry over a 2-entry cache must evict "b", not "a".
+	if _, err := c.Get("c", smallImageLoader); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Stats().Entries != 2 {
+		t.Fatalf("Entries = %d, want 2", c.Stats().Entries)
+	}
+	if countQueuedDisposes(imgB) != 1 {
+		t.Errorf("evicted image was not disposed exactly once")
+	}
+	if countQueuedDisposes(imgA) != 0 {
+		t.Errorf("still-cached image was disposed")
+	}
+
+	// "b" is gone from the cache but the caller's reference (imgB) is
+	// still live; removing the already-evicted key again must not queue
+	// a second dispose for it.
+	c.Remove("b")
+	if countQueuedDisposes(imgB) != 1 {
+		t.Errorf("evicting an already-evicted key queued a duplicate dispose")
+	}
+}
+
+func TestImageCacheEvictsByByteBudget(t *testing.T) {
+	defer withDeferredCommands(t)()
+
+	// Each 4x4 RGBA image costs 4*4*4 = 64 bytes; budget for one.
+	c := NewImageCache(0, 64, FilterNearest)
+
+	imgA, err := c.Get("a", smallImageLoader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("b", smallImageLoader); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Stats().Entries != 1 {
+		t.Fatalf("Entries = %d, want 1", c.Stats().Entries)
+	}
+	if c.Stats().Bytes != 64 {
+		t.Fatalf("Bytes = %d, want 64", c.Stats().Bytes)
+	}
+	if countQueuedDisposes(imgA) != 1 {
+		t.Errorf("over-budget image was not disposed")
+	}
+}
+
+func TestImageCacheKeepsOversizedSingleImage(t *testing.T) {
+	defer withDeferredCommands(t)()
+
+	// A single 4x4 RGBA image costs 64 bytes, well over this budget.
+	// It must still be cached rather than disposed and reloaded on
+	// every Get.
+	c := NewImageCache(0, 1, FilterNearest)
+
+	img, err := c.Get("a", smallImageLoader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Stats().Entries != 1 {
+		t.Fatalf("Entries = %d, want 1", c.Stats().Entries)
+	}
+	if countQueuedDisposes(img) != 0 {
+		t.Errorf("sole over-budget image was disposed")
+	}
+
+	got, err := c.Get("a", smallImageLoader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != img {
+		t.Errorf("Get returned a different image; want the cached one to survive")
+	}
+	if c.Stats().Hits != 1 {
+		t.Errorf("Hits = %d, want 1", c.Stats().Hits)
+	}
+	if countQueuedDisposes(img) != 0 {
+		t.Errorf("cached image was disposed after a hit")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2014 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebiten
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	imageDecodersM sync.Mutex
+	imageDecoders  = map[string]func(io.Reader) (image.Image, error){}
+)
+
+// RegisterImageDecoder associates mimeType with a function that decodes an
+// io.Reader into an image.Image. NewImageFromReader and NewImageFromFile
+// dispatch to the registered decoder for the MIME type they are given (or
+// that they sniff).
+//
+// This lets games wire in formats like JPEG, WebP or KTX without the game
+// binary having to import the corresponding image/* package (and thereby
+// registering it with image.Decode) just to reach this function.
+//
+// RegisterImageDecoder is concurrent-safe with itself, NewImageFromReader
+// and NewImageFromFile; all three take imageDecodersM around their access
+// to the registry. Even so, register decoders for the formats a game
+// needs before it starts decoding with them, typically from an init
+// function, rather than racing registration against first use.
+func RegisterImageDecoder(mimeType string, dec func(io.Reader) (image.Image, error)) {
+	imageDecodersM.Lock()
+	defer imageDecodersM.Unlock()
+	imageDecoders[mimeType] = dec
+}
+
+// imageDecoderSniffLen is the number of bytes buffered for
+// http.DetectContentType, which inspects at most 512 bytes.
+const imageDecoderSniffLen = 512
+
+// NewImageFromReader decodes the image data read from r as mimeType and
+// creates a new image from it.
+//
+// If mimeType is empty, NewImageFromReader sniffs the content type from
+// the first bytes of r using http.DetectContentType.
+//
+// NewImageFromReader generates a new texture and a new framebuffer.
+// Be careful that image objects will never be released
+// even though nothing refers the image object and GC works.
+// It is because there is no way to define finalizers for Go objects if you use GopherJS.
+//
+// This function is concurrent-safe.
+func NewImageFromReader(r io.Reader, mimeType string, filter Filter) (*Image, error) {
+	br := bufio.NewReaderSize(r, imageDecoderSniffLen)
+	if mimeType == "" {
+		prefix, err := br.Peek(imageDecoderSniffLen)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		mimeType = http.DetectContentType(prefix)
+	}
+
+	imageDecodersM.Lock()
+	dec, ok := imageDecoders[mimeType]
+	imageDecodersM.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("ebiten: NewImageFromReader: no decoder registered for MIME type %q", mimeType)
+	}
+
+	img, err := dec(br)
+	if err != nil {
+		return nil, err
+	}
+	return NewImageFromImage(img, filter)
+}
+
+// imageDecoderExtToMimeType maps the common image file extensions to the
+// MIME type NewImageFromFile looks them up by. This is sugar over
+// NewImageFromReader for the common case of loading assets from disk by
+// path; callers that already know their MIME type should call
+// NewImageFromReader directly.
+var imageDecoderExtToMimeType = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+}
+
+// NewImageFromFile decodes the image file at path and creates a new image
+// from it. The MIME type is derived from the file's extension; see
+// RegisterImageDecoder to wire in a decoder for it.
+//
+// This function is concurrent-safe.
+func NewImageFromFile(path string, filter Filter) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mimeType := imageDecoderExtToMimeType[filepath.Ext(path)]
+	return NewImageFromReader(f, mimeType, filter)
+}
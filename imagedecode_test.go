@@ -0,0 +1,99 @@
+// Copyright 2014 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebiten
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"testing"
+)
+
+const testMimeType = "application/x-ebiten-test-image"
+
+func registerTestDecoder(t *testing.T) {
+	t.Helper()
+	RegisterImageDecoder(testMimeType, func(r io.Reader) (image.Image, error) {
+		if _, err := io.ReadAll(r); err != nil {
+			return nil, err
+		}
+		return image.NewRGBA(image.Rect(0, 0, 2, 2)), nil
+	})
+	t.Cleanup(func() {
+		imageDecodersM.Lock()
+		delete(imageDecoders, testMimeType)
+		imageDecodersM.Unlock()
+	})
+}
+
+func TestNewImageFromReaderDispatchesByMimeType(t *testing.T) {
+	defer withDeferredCommands(t)()
+	registerTestDecoder(t)
+
+	img, err := NewImageFromReader(bytes.NewReader([]byte("fake image bytes")), testMimeType, FilterNearest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := img.Size(); w != 2 || h != 2 {
+		t.Errorf("Size() = (%d, %d), want (2, 2)", w, h)
+	}
+}
+
+func TestNewImageFromReaderSniffsContentType(t *testing.T) {
+	defer withDeferredCommands(t)()
+
+	// A well-formed, minimal PNG signature is enough for
+	// http.DetectContentType to report "image/png"; register a decoder
+	// for it instead of importing image/png.
+	RegisterImageDecoder("image/png", func(r io.Reader) (image.Image, error) {
+		if _, err := io.ReadAll(r); err != nil {
+			return nil, err
+		}
+		return image.NewRGBA(image.Rect(0, 0, 1, 1)), nil
+	})
+	defer func() {
+		imageDecodersM.Lock()
+		delete(imageDecoders, "image/png")
+		imageDecodersM.Unlock()
+	}()
+
+	pngSignature := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+	if _, err := NewImageFromReader(bytes.NewReader(pngSignature), "", FilterNearest); err != nil {
+		t.Fatalf("NewImageFromReader with sniffed MIME type failed: %v", err)
+	}
+}
+
+func TestNewImageFromReaderUnknownMimeType(t *testing.T) {
+	defer withDeferredCommands(t)()
+
+	_, err := NewImageFromReader(bytes.NewReader(nil), "application/x-no-such-decoder", FilterNearest)
+	if err == nil {
+		t.Fatal("NewImageFromReader with no registered decoder returned a nil error")
+	}
+}
+
+func TestImageDecoderExtToMimeType(t *testing.T) {
+	want := map[string]string{
+		".png":  "image/png",
+		".jpg":  "image/jpeg",
+		".jpeg": "image/jpeg",
+		".gif":  "image/gif",
+	}
+	for ext, mimeType := range want {
+		if got := imageDecoderExtToMimeType[ext]; got != mimeType {
+			t.Errorf("imageDecoderExtToMimeType[%q] = %q, want %q", ext, got, mimeType)
+		}
+	}
+}
@@ -0,0 +1,596 @@
+// Copyright 2014 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebiten
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"sort"
+
+	"github.com/hajimehoshi/ebiten/internal/graphics"
+)
+
+// QuantizeOptions controls the behavior of Quantize.
+type QuantizeOptions struct {
+	// DitherLevel is the strength of Floyd-Steinberg error diffusion
+	// applied while assigning pixels to the palette, in [0, 1]. 0 means
+	// no dithering (nearest palette color only); 1 means the full
+	// diffused error is carried to neighboring pixels. Values outside
+	// [0, 1] are clamped.
+	DitherLevel float64
+}
+
+// quantizeHistogramBits is the number of the most significant bits kept
+// per channel when building the color histogram. Keeping fewer than 8
+// bits bounds the histogram's size while still giving the median-cut
+// algorithm enough resolution to find good splits.
+const quantizeHistogramBits = 5
+
+const quantizeHistogramShift = 8 - quantizeHistogramBits
+
+// quantizeChannelWeights perceptually weight channel distances so that,
+// e.g., a change in green looks more significant than the same numeric
+// change in blue. Alpha is weighted fully since a difference in opacity
+// is always visually significant.
+var quantizeChannelWeights = [4]float64{0.299, 0.587, 0.114, 1}
+
+type histogramEntry struct {
+	r, g, b, a uint8
+	count      uint32
+}
+
+// vbox is a box in 4-D RGBA space together with the histogram entries it
+// contains. This is the "vbox" of the modified median cut algorithm.
+type vbox struct {
+	entries    []*histogramEntry
+	rMin, rMax uint8
+	gMin, gMax uint8
+	bMin, bMax uint8
+	aMin, aMax uint8
+	population uint32
+}
+
+func newVBox(entries []*histogramEntry) *vbox {
+	v := &vbox{entries: entries}
+	v.recalc()
+	return v
+}
+
+func (v *vbox) recalc() {
+	v.rMin, v.gMin, v.bMin, v.aMin = 255, 255, 255, 255
+	v.rMax, v.gMax, v.bMax, v.aMax = 0, 0, 0, 0
+	v.population = 0
+	for _, e := range v.entries {
+		if e.r < v.rMin {
+			v.rMin = e.r
+		}
+		if e.r > v.rMax {
+			v.rMax = e.r
+		}
+		if e.g < v.gMin {
+			v.gMin = e.g
+		}
+		if e.g > v.gMax {
+			v.gMax = e.g
+		}
+		if e.b < v.bMin {
+			v.bMin = e.b
+		}
+		if e.b > v.bMax {
+			v.bMax = e.b
+		}
+		if e.a < v.aMin {
+			v.aMin = e.a
+		}
+		if e.a > v.aMax {
+			v.aMax = e.a
+		}
+		v.population += e.count
+	}
+}
+
+func (v *vbox) volume() int64 {
+	r := int64(v.rMax-v.rMin) + 1
+	g := int64(v.gMax-v.gMin) + 1
+	b := int64(v.bMax-v.bMin) + 1
+	a := int64(v.aMax-v.aMin) + 1
+	return r * g * b * a
+}
+
+// widestChannel returns the index (0=r, 1=g, 2=b, 3=a) of the channel
+// with the greatest weighted variance, and whether the box can be split
+// at all (a box of a single distinct color cannot).
+func (v *vbox) widestChannel() (channel int, splittable bool) {
+	variances := v.channelVariances()
+	best := 0
+	for i := 1; i < 4; i++ {
+		if variances[i] > variances[best] {
+			best = i
+		}
+	}
+	return best, variances[best] > 0
+}
+
+// channelVariances returns the population-weighted, perceptually
+// weighted variance of each channel around the box's mean color.
+func (v *vbox) channelVariances() [4]float64 {
+	if v.population == 0 {
+		return [4]float64{}
+	}
+	avg := v.average()
+	mean := [4]float64{float64(avg.R), float64(avg.G), float64(avg.B), float64(avg.A)}
+	var sum [4]float64
+	for _, e := range v.entries {
+		w := float64(e.count)
+		d := [4]float64{
+			float64(e.r) - mean[0],
+			float64(e.g) - mean[1],
+			float64(e.b) - mean[2],
+			float64(e.a) - mean[3],
+		}
+		for c := 0; c < 4; c++ {
+			sum[c] += quantizeChannelWeights[c] * d[c] * d[c] * w
+		}
+	}
+	for c := 0; c < 4; c++ {
+		sum[c] /= float64(v.population)
+	}
+	return sum
+}
+
+func channelOf(e *histogramEntry, channel int) uint8 {
+	switch channel {
+	case 0:
+		return e.r
+	case 1:
+		return e.g
+	case 2:
+		return e.b
+	default:
+		return e.a
+	}
+}
+
+// split cuts v along its widest channel at the weighted median, and
+// returns the two resulting boxes.
+func (v *vbox) split() (*vbox, *vbox) {
+	channel, _ := v.widestChannel()
+	sorted := make([]*histogramEntry, len(v.entries))
+	copy(sorted, v.entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return channelOf(sorted[i], channel) < channelOf(sorted[j], channel)
+	})
+
+	half := v.population / 2
+	var accum uint32
+	cut := len(sorted) - 1
+	for i, e := range sorted {
+		accum += e.count
+		if accum >= half {
+			cut = i
+			break
+		}
+	}
+	if cut == 0 {
+		cut = 1
+	}
+	if cut >= len(sorted) {
+		cut = len(sorted) - 1
+	}
+
+	lo := newVBox(sorted[:cut])
+	hi := newVBox(sorted[cut:])
+	return lo, hi
+}
+
+// variance returns the population-weighted, perceptually weighted
+// variance of the box's entries around their mean color, summed across
+// channels.
+func (v *vbox) variance() float64 {
+	var sum float64
+	for _, c := range v.channelVariances() {
+		sum += c
+	}
+	return sum
+}
+
+// priority orders vboxes during splitting: the modified median cut
+// algorithm favors splitting the box with the largest product of
+// volume, population and variance, which in practice tends to give
+// large, densely populated, visually varied boxes their own palette
+// entries first.
+func (v *vbox) priority() float64 {
+	return float64(v.volume()) * float64(v.population) * v.variance()
+}
+
+// average returns the population-weighted mean color of the box, which
+// becomes its palette entry.
+func (v *vbox) average() color.NRGBA {
+	if v.population == 0 {
+		return color.NRGBA{}
+	}
+	var r, g, b, a uint64
+	for _, e := range v.entries {
+		w := uint64(e.count)
+		r += uint64(e.r) * w
+		g += uint64(e.g) * w
+		b += uint64(e.b) * w
+		a += uint64(e.a) * w
+	}
+	n := uint64(v.population)
+	return color.NRGBA{
+		R: uint8(r / n),
+		G: uint8(g / n),
+		B: uint8(b / n),
+		A: uint8(a / n),
+	}
+}
+
+// quantizeSourcePixels reads all of src's pixels as premultiplied RGBA in
+// a single pass, the same data Image.At would return for each pixel, but
+// taking imageM once for the whole image instead of once per pixel.
+//
+// Like At, this can't be called before the GL context is initialized
+// (i.e. before the main loop, ebiten.Run, starts).
+func quantizeSourcePixels(src *Image) ([]color.RGBA, error) {
+	imageM.Lock()
+	defer imageM.Unlock()
+
+	w, h := src.width, src.height
+	out := make([]color.RGBA, w*h)
+
+	if imageCommandQueue != nil {
+		panic("ebiten: Quantize can't be called when the GL context is not initialized")
+	}
+	if src.isDisposed() {
+		return out, nil
+	}
+	if src.pixels == nil {
+		var err error
+		src.pixels, err = src.framebuffer.Pixels(glContext)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stride := int(graphics.NextPowerOf2Int32(int32(w)))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			idx := 4*x + 4*y*stride
+			out[y*w+x] = color.RGBA{
+				R: src.pixels[idx],
+				G: src.pixels[idx+1],
+				B: src.pixels[idx+2],
+				A: src.pixels[idx+3],
+			}
+		}
+	}
+	return out, nil
+}
+
+// Quantize reduces src to at most maxColors colors using the modified
+// median cut algorithm (the approach used by libimagequant), returning
+// the resulting palette and an image.Paletted of src's bounds indexing
+// into it. maxColors is clamped to [2, 256].
+//
+// Fully transparent pixels are always mapped to a dedicated transparent
+// palette entry rather than being clustered with opaque colors.
+//
+// Quantize is deterministic: calling it twice with the same src, the
+// same maxColors and equal opts always produces the same palette and
+// the same indices.
+//
+// Quantize reads every pixel of src, so, like Image.At, it can't be
+// called before the main loop (ebiten.Run) starts.
+func Quantize(src *Image, maxColors int, opts *QuantizeOptions) (*color.Palette, *image.Paletted, error) {
+	if src == nil {
+		return nil, nil, errors.New("ebiten: Quantize: src must not be nil")
+	}
+	if maxColors < 2 {
+		maxColors = 2
+	}
+	if maxColors > 256 {
+		maxColors = 256
+	}
+	dither := 0.0
+	if opts != nil {
+		dither = opts.DitherLevel
+		if dither < 0 {
+			dither = 0
+		}
+		if dither > 1 {
+			dither = 1
+		}
+	}
+
+	w, h := src.width, src.height
+	pixels, err := quantizeSourcePixels(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hasTransparent := false
+	hist := map[uint32]*histogramEntry{}
+	for _, p := range pixels {
+		c := color.NRGBAModel.Convert(p).(color.NRGBA)
+		if c.A == 0 {
+			hasTransparent = true
+			continue
+		}
+		key := quantizeKey(c)
+		if e, ok := hist[key]; ok {
+			e.count++
+		} else {
+			hist[key] = &histogramEntry{r: c.R, g: c.G, b: c.B, a: c.A, count: 1}
+		}
+	}
+
+	colorBudget := maxColors
+	if hasTransparent {
+		colorBudget--
+	}
+	if colorBudget < 1 {
+		colorBudget = 1
+	}
+
+	palette := color.Palette{}
+	transparentIndex := -1
+	if hasTransparent {
+		transparentIndex = 0
+		palette = append(palette, color.NRGBA{})
+	}
+
+	if len(hist) > 0 {
+		entries := make([]*histogramEntry, 0, len(hist))
+		for _, e := range hist {
+			entries = append(entries, e)
+		}
+		// Sort for determinism: map iteration order is randomized, but
+		// the split algorithm only depends on entry order within a
+		// channel, which sort.Slice below reestablishes regardless.
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].r != entries[j].r {
+				return entries[i].r < entries[j].r
+			}
+			if entries[i].g != entries[j].g {
+				return entries[i].g < entries[j].g
+			}
+			if entries[i].b != entries[j].b {
+				return entries[i].b < entries[j].b
+			}
+			return entries[i].a < entries[j].a
+		})
+
+		boxes := []*vbox{newVBox(entries)}
+		for len(boxes) < colorBudget {
+			best := -1
+			for i, b := range boxes {
+				if len(b.entries) < 2 {
+					continue
+				}
+				if _, splittable := b.widestChannel(); !splittable {
+					continue
+				}
+				if best == -1 || b.priority() > boxes[best].priority() {
+					best = i
+				}
+			}
+			if best == -1 {
+				break
+			}
+			lo, hi := boxes[best].split()
+			boxes[best] = lo
+			boxes = append(boxes, hi)
+		}
+
+		for _, b := range boxes {
+			if b.population == 0 {
+				continue
+			}
+			palette = append(palette, b.average())
+		}
+	}
+
+	if len(palette) == 0 {
+		palette = append(palette, color.NRGBA{R: 0, G: 0, B: 0, A: 255})
+	}
+
+	paletted := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+
+	var errs [][]quantizeErrCell
+	if dither > 0 {
+		errs = make([][]quantizeErrCell, h+1)
+		for y := range errs {
+			errs[y] = make([]quantizeErrCell, w+2)
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(pixels[y*w+x]).(color.NRGBA)
+			if c.A == 0 && transparentIndex >= 0 {
+				paletted.SetColorIndex(x, y, uint8(transparentIndex))
+				continue
+			}
+
+			cr, cg, cb, ca := float64(c.R), float64(c.G), float64(c.B), float64(c.A)
+			if errs != nil {
+				cell := errs[y][x+1]
+				cr += cell.r
+				cg += cell.g
+				cb += cell.b
+				ca += cell.a
+			}
+
+			idx, nearest := quantizeNearest(palette, transparentIndex, cr, cg, cb, ca)
+			paletted.SetColorIndex(x, y, uint8(idx))
+
+			if errs != nil {
+				er := (cr - float64(nearest.R)) * dither
+				eg := (cg - float64(nearest.G)) * dither
+				eb := (cb - float64(nearest.B)) * dither
+				ea := (ca - float64(nearest.A)) * dither
+				quantizeDiffuse(errs, x, y, w, er, eg, eb, ea)
+			}
+		}
+	}
+
+	return &palette, paletted, nil
+}
+
+// quantizeErrCell accumulates Floyd-Steinberg error diffused into a
+// not-yet-visited pixel.
+type quantizeErrCell struct{ r, g, b, a float64 }
+
+func quantizeKey(c color.NRGBA) uint32 {
+	r := uint32(c.R) >> quantizeHistogramShift
+	g := uint32(c.G) >> quantizeHistogramShift
+	b := uint32(c.B) >> quantizeHistogramShift
+	a := uint32(c.A) >> quantizeHistogramShift
+	return r<<15 | g<<10 | b<<5 | a
+}
+
+// quantizeNearest finds the palette entry closest to (r, g, b, a) by
+// squared distance after scaling each channel's difference by
+// quantizeChannelWeights, skipping the dedicated transparent slot
+// (opaque pixels never map to it).
+func quantizeNearest(palette color.Palette, transparentIndex int, r, g, b, a float64) (int, color.NRGBA) {
+	best := -1
+	bestDist := 0.0
+	var bestColor color.NRGBA
+	for i, pc := range palette {
+		if i == transparentIndex {
+			continue
+		}
+		c := pc.(color.NRGBA)
+		dr := (r - float64(c.R)) * quantizeChannelWeights[0]
+		dg := (g - float64(c.G)) * quantizeChannelWeights[1]
+		db := (b - float64(c.B)) * quantizeChannelWeights[2]
+		da := (a - float64(c.A)) * quantizeChannelWeights[3]
+		dist := dr*dr + dg*dg + db*db + da*da
+		if best == -1 || dist < bestDist {
+			best, bestDist, bestColor = i, dist, c
+		}
+	}
+	if best == -1 {
+		return 0, color.NRGBA{}
+	}
+	return best, bestColor
+}
+
+// quantizeDiffuse spreads a pixel's quantization error to its
+// right, bottom-left, bottom and bottom-right neighbors using the
+// classic Floyd-Steinberg coefficients (7/16, 3/16, 5/16, 1/16).
+func quantizeDiffuse(errs [][]quantizeErrCell, x, y, w int, er, eg, eb, ea float64) {
+	add := func(dx, dy int, weight float64) {
+		nx := x + dx + 1
+		if nx < 0 || nx >= w+2 {
+			return
+		}
+		cell := &errs[y+dy][nx]
+		cell.r += er * weight
+		cell.g += eg * weight
+		cell.b += eb * weight
+		cell.a += ea * weight
+	}
+	add(1, 0, 7.0/16)
+	add(-1, 1, 3.0/16)
+	add(0, 1, 5.0/16)
+	add(1, 1, 1.0/16)
+}
+
+// PalettedImage holds the raw 8-bit indices and the small color.Palette
+// they index into, the data a true indexed-texture-plus-palette-uniform
+// upload would need: one index byte per pixel on the GPU side, and the
+// palette as a uniform the fragment shader looks colors up in.
+//
+// ebiten's draw pipeline can't consume this directly: newImageCommand
+// and drawImageCommand, the command types a texture upload and a draw
+// go through, only know how to allocate and blend RGBA8 textures, and
+// DrawImageOptions has no field for a per-draw shader uniform to hang a
+// palette off of. Wiring that in is a separate, backend-level change.
+// PalettedImage exists so that information isn't thrown away in the
+// meantime: callers driving their own renderer (or a future ebiten
+// backend with shader support) still get the indices and palette
+// without re-running Quantize.
+type PalettedImage struct {
+	// Width and Height are the image's dimensions in pixels.
+	Width, Height int
+
+	// Indices holds one palette index per pixel, row-major starting at
+	// the top-left, len(Indices) == Width*Height.
+	Indices []uint8
+
+	// Palette is the color each index in Indices refers to.
+	Palette color.Palette
+}
+
+// NewPalettedImage copies p's indices and palette into a PalettedImage.
+func NewPalettedImage(p *image.Paletted) *PalettedImage {
+	b := p.Bounds()
+	w, h := b.Dx(), b.Dy()
+	indices := make([]uint8, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			indices[y*w+x] = p.ColorIndexAt(b.Min.X+x, b.Min.Y+y)
+		}
+	}
+	palette := make(color.Palette, len(p.Palette))
+	copy(palette, p.Palette)
+	return &PalettedImage{
+		Width:   w,
+		Height:  h,
+		Indices: indices,
+		Palette: palette,
+	}
+}
+
+// NewImageFromPaletted creates a new image from a paletted image.
+//
+// As explained on PalettedImage, the existing draw pipeline has no
+// indexed-texture-plus-palette-uniform path, so this expands p to full
+// RGBA pixels before uploading, the same VRAM cost as NewImageFromImage.
+// It expands p directly from its Pix and Palette, rather than
+// round-tripping through the generic image.Image path NewImageFromImage
+// uses, which is at least free of per-pixel interface dispatch.
+//
+// This function is concurrent-safe.
+func NewImageFromPaletted(p *image.Paletted, filter Filter) (*Image, error) {
+	b := p.Bounds()
+	w, h := b.Dx(), b.Dy()
+	colors := make([]color.RGBA, len(p.Palette))
+	for i, pc := range p.Palette {
+		colors[i] = color.RGBAModel.Convert(pc).(color.RGBA)
+	}
+	pix := make([]uint8, 4*w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			idx := p.ColorIndexAt(b.Min.X+x, b.Min.Y+y)
+			c := colors[idx]
+			o := 4 * (y*w + x)
+			pix[o], pix[o+1], pix[o+2], pix[o+3] = c.R, c.G, c.B, c.A
+		}
+	}
+
+	img, err := NewImage(w, h, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := img.ReplacePixels(pix); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
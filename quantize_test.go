@@ -0,0 +1,226 @@
+// Copyright 2014 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebiten
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// newTestImage builds an *Image backed by an explicit pixel buffer
+// instead of a real texture, so Quantize's pure-Go logic can be
+// exercised without a GL context. width must be a power of two so that
+// the row stride quantizeSourcePixels computes equals width.
+func newTestImage(width, height int, px []color.RGBA) *Image {
+	if len(px) != width*height {
+		panic("newTestImage: wrong pixel count")
+	}
+	pixels := make([]uint8, 4*width*height)
+	for i, c := range px {
+		pixels[4*i], pixels[4*i+1], pixels[4*i+2], pixels[4*i+3] = c.R, c.G, c.B, c.A
+	}
+	return &Image{width: width, height: height, pixels: pixels}
+}
+
+func TestQuantizeClampsMaxColors(t *testing.T) {
+	px := []color.RGBA{
+		{R: 0, G: 0, B: 0, A: 255}, {R: 255, G: 0, B: 0, A: 255},
+		{R: 0, G: 255, B: 0, A: 255}, {R: 0, G: 0, B: 255, A: 255},
+	}
+	img := newTestImage(2, 2, px)
+
+	palette, _, err := Quantize(img, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*palette) != 2 {
+		t.Errorf("maxColors=0: len(palette) = %d, want 2 (clamped)", len(*palette))
+	}
+
+	palette, _, err = Quantize(img, 100000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*palette) > 256 {
+		t.Errorf("maxColors=100000: len(palette) = %d, want <= 256 (clamped)", len(*palette))
+	}
+}
+
+func TestQuantizeNilSource(t *testing.T) {
+	if _, _, err := Quantize(nil, 4, nil); err == nil {
+		t.Error("Quantize(nil, ...) returned a nil error, want non-nil")
+	}
+}
+
+func TestQuantizeDeterministic(t *testing.T) {
+	px := []color.RGBA{
+		{R: 10, G: 20, B: 30, A: 255}, {R: 200, G: 20, B: 30, A: 255},
+		{R: 10, G: 220, B: 30, A: 255}, {R: 10, G: 20, B: 230, A: 255},
+	}
+	img := newTestImage(2, 2, px)
+
+	p1, i1, err := Quantize(img, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, i2, err := Quantize(img, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(*p1, *p2) {
+		t.Errorf("palettes differ between runs:\n%v\n%v", *p1, *p2)
+	}
+	if !reflect.DeepEqual(i1.Pix, i2.Pix) {
+		t.Errorf("indices differ between runs:\n%v\n%v", i1.Pix, i2.Pix)
+	}
+}
+
+func TestQuantizeTransparentSlot(t *testing.T) {
+	px := []color.RGBA{
+		{R: 0, G: 0, B: 0, A: 255}, {R: 255, G: 255, B: 255, A: 255},
+		{R: 10, G: 10, B: 10, A: 255}, {R: 0, G: 0, B: 0, A: 0}, // fully transparent
+	}
+	img := newTestImage(2, 2, px)
+
+	palette, paletted, err := Quantize(img, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zero := color.NRGBA{}
+	if (*palette)[0] != zero {
+		t.Fatalf("palette[0] = %v, want the dedicated transparent entry %v", (*palette)[0], zero)
+	}
+	if got := paletted.ColorIndexAt(1, 1); got != 0 {
+		t.Errorf("transparent pixel mapped to index %d, want 0", got)
+	}
+}
+
+func TestQuantizeDitherLevelClamped(t *testing.T) {
+	px := []color.RGBA{
+		{R: 0, G: 0, B: 0, A: 255}, {R: 255, G: 255, B: 255, A: 255},
+		{R: 10, G: 10, B: 10, A: 255}, {R: 245, G: 245, B: 245, A: 255},
+	}
+	img := newTestImage(2, 2, px)
+
+	// Out-of-range DitherLevel must be clamped, not rejected or panic.
+	if _, _, err := Quantize(img, 2, &QuantizeOptions{DitherLevel: -5}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Quantize(img, 2, &QuantizeOptions{DitherLevel: 5}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuantizeDiffuseFloydSteinbergWeights(t *testing.T) {
+	w := 3
+	errs := make([][]quantizeErrCell, 3)
+	for y := range errs {
+		errs[y] = make([]quantizeErrCell, w+2)
+	}
+
+	// Diffuse from the middle pixel of the middle row: (x=1, y=1).
+	quantizeDiffuse(errs, 1, 1, w, 16, 0, 0, 0)
+
+	cases := []struct {
+		y, x int
+		want float64
+	}{
+		{1, 2 + 1, 7}, // right
+		{2, 0 + 1, 3}, // bottom-left
+		{2, 1 + 1, 5}, // bottom
+		{2, 2 + 1, 1}, // bottom-right
+	}
+	for _, c := range cases {
+		if got := errs[c.y][c.x].r; got != c.want {
+			t.Errorf("errs[%d][%d].r = %v, want %v", c.y, c.x, got, c.want)
+		}
+	}
+}
+
+func TestVBoxPriorityReflectsVariance(t *testing.T) {
+	uniform := newVBox([]*histogramEntry{
+		{r: 100, g: 100, b: 100, a: 255, count: 1},
+		{r: 100, g: 100, b: 100, a: 255, count: 1},
+	})
+	if got := uniform.variance(); got != 0 {
+		t.Errorf("uniform box variance = %v, want 0", got)
+	}
+
+	spread := newVBox([]*histogramEntry{
+		{r: 0, g: 0, b: 0, a: 255, count: 1},
+		{r: 255, g: 255, b: 255, a: 255, count: 1},
+	})
+	if got := spread.variance(); got <= 0 {
+		t.Errorf("spread box variance = %v, want > 0", got)
+	}
+	if uniform.priority() != 0 {
+		t.Errorf("uniform box priority = %v, want 0", uniform.priority())
+	}
+	if spread.priority() <= 0 {
+		t.Errorf("spread box priority = %v, want > 0", spread.priority())
+	}
+}
+
+func TestVBoxWidestChannelPicksVarianceOverRange(t *testing.T) {
+	// The green channel has the widest range (0-255), but only a single
+	// outlier pixel sits at its top, while red has a narrower range
+	// (0-100) with its mass split evenly between both ends. Picking by
+	// range would choose green; the weighted variance of red (about 748)
+	// exceeds that of green (about 189), so red must be chosen.
+	v := newVBox([]*histogramEntry{
+		{r: 0, g: 0, b: 0, a: 255, count: 100},
+		{r: 100, g: 0, b: 0, a: 255, count: 100},
+		{r: 0, g: 255, b: 0, a: 255, count: 1},
+	})
+	channel, splittable := v.widestChannel()
+	if !splittable {
+		t.Fatal("widestChannel() splittable = false, want true")
+	}
+	if channel != 0 {
+		t.Errorf("widestChannel() channel = %d, want 0 (red)", channel)
+	}
+}
+
+func TestNewPalettedImageCopiesIndicesAndPalette(t *testing.T) {
+	palette := color.Palette{
+		color.NRGBA{R: 255, A: 255},
+		color.NRGBA{G: 255, A: 255},
+	}
+	src := image.NewPaletted(image.Rect(0, 0, 2, 1), palette)
+	src.SetColorIndex(0, 0, 0)
+	src.SetColorIndex(1, 0, 1)
+
+	pi := NewPalettedImage(src)
+	if pi.Width != 2 || pi.Height != 1 {
+		t.Fatalf("size = %dx%d, want 2x1", pi.Width, pi.Height)
+	}
+	if got, want := pi.Indices, []uint8{0, 1}; got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Indices = %v, want %v", got, want)
+	}
+	if len(pi.Palette) != len(palette) {
+		t.Fatalf("Palette len = %d, want %d", len(pi.Palette), len(palette))
+	}
+
+	// The returned palette must be a copy: mutating the source must not
+	// affect the already-constructed PalettedImage.
+	palette[0] = color.NRGBA{B: 255, A: 255}
+	if pi.Palette[0] == palette[0] {
+		t.Errorf("PalettedImage.Palette aliases the source palette")
+	}
+}